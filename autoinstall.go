@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const autoinstallISOFilename = "seed.iso"
+
+// ignitionShutdownUnitName is the systemd unit injected into Ignition
+// configs to signal install completion.
+const ignitionShutdownUnitName = "vm-installer-shutdown.service"
+
+// ignitionShutdownUnitContents returns the contents of the systemd unit
+// that runs echoToken once multi-user.target is reached, i.e. once
+// Ignition's firstboot provisioning has finished.
+func ignitionShutdownUnitContents(echoToken string) string {
+	return fmt.Sprintf(
+		"[Unit]\nDescription=Signal vm-installer that the install has finished\nAfter=multi-user.target\n\n[Service]\nType=oneshot\nExecStart=/bin/sh -c '%s'\n\n[Install]\nWantedBy=multi-user.target\n",
+		echoToken,
+	)
+}
+
+// prepareAutoinstall builds the small seed ISO carrying the user's answer
+// file and returns the extra qemu-system-x86_64 arguments needed to attach
+// it and tell the installer kernel where to find it, so runMachine never
+// has to wait on stdin.
+func (i *Installer) prepareAutoinstall() ([]string, string, error) {
+	output, err := i.buildAutoinstallISO()
+	if err != nil {
+		return nil, output, err
+	}
+
+	isoPath := filepath.Join(i.contextDir, autoinstallISOFilename)
+	args := []string{
+		"-drive", fmt.Sprintf("file=%s,media=cdrom", isoPath),
+		"-append", autoinstallKernelArgs(i.config.autoinstallType),
+	}
+	return args, "", nil
+}
+
+// buildAutoinstallISO copies the user's answer file into the build context,
+// injects a hook that shuts the guest down once unattended install
+// finishes, and burns it onto a small ISO that QEMU attaches as a second
+// cdrom.
+func (i *Installer) buildAutoinstallISO() (string, error) {
+	seedDir := filepath.Join(i.contextDir, "seed")
+	if err := os.MkdirAll(seedDir, 0755); err != nil {
+		return "", err
+	}
+
+	contents, err := ioutil.ReadFile(i.config.autoinstallFile)
+	if err != nil {
+		return "", err
+	}
+	contents, err = injectShutdownHook(contents, i.config.autoinstallType)
+	if err != nil {
+		return "", err
+	}
+
+	answerFilename, volumeLabel := autoinstallLayout(i.config.autoinstallType)
+	if err := ioutil.WriteFile(filepath.Join(seedDir, answerFilename), contents, 0644); err != nil {
+		return "", err
+	}
+	if i.config.autoinstallType == "autoinstall" {
+		// cloud-init's NoCloud datasource requires a meta-data file
+		// alongside user-data, even if it is empty.
+		if err := ioutil.WriteFile(filepath.Join(seedDir, "meta-data"), []byte{}, 0644); err != nil {
+			return "", err
+		}
+	}
+
+	isoPath := filepath.Join(i.contextDir, autoinstallISOFilename)
+	return runStreamed("genisoimage", "-output", isoPath, "-volid", volumeLabel, "-joliet", "-rock", seedDir)
+}
+
+// autoinstallLayout returns the filename the installer expects the answer
+// file under and the ISO volume label it looks for it on.
+func autoinstallLayout(autoinstallType string) (filename, volumeLabel string) {
+	switch autoinstallType {
+	case "preseed":
+		return "preseed.cfg", "SEED"
+	case "kickstart":
+		return "ks.cfg", "OEMDRV"
+	case "autoinstall":
+		return "user-data", "cidata"
+	case "ignition":
+		return "config.ign", "config-2"
+	}
+	return "", ""
+}
+
+// autoinstallKernelArgs returns the installer kernel command line that
+// points the guest at the answer file on the attached seed ISO.
+func autoinstallKernelArgs(autoinstallType string) string {
+	switch autoinstallType {
+	case "preseed":
+		return "auto=true priority=critical preseed/file=/cdrom/preseed.cfg"
+	case "kickstart":
+		return "inst.ks=cdrom:/ks.cfg"
+	case "autoinstall":
+		return "autoinstall ds=nocloud"
+	case "ignition":
+		return "ignition.config.url=file:///cdrom/config.ign ignition.firstboot"
+	}
+	return ""
+}
+
+// injectShutdownHook appends a directive that echoes shutdownToken to the
+// serial console once the unattended install completes, so watchSerial can
+// tell runMachine to drive the guest shutdown over QMP instead of leaving
+// it waiting forever. Ignition's config is JSON, so it gets a systemd unit
+// merged into "systemd.units" instead of a text append.
+func injectShutdownHook(contents []byte, autoinstallType string) ([]byte, error) {
+	echoToken := fmt.Sprintf("echo %s > /dev/ttyS0", shutdownToken)
+	switch autoinstallType {
+	case "preseed":
+		return append(contents, []byte(fmt.Sprintf("\nd-i preseed/late_command string in-target sh -c '%s'\n", echoToken))...), nil
+	case "kickstart":
+		return append(contents, []byte(fmt.Sprintf("\n%%post\n%s\n%%end\n", echoToken))...), nil
+	case "autoinstall":
+		return append(contents, []byte(fmt.Sprintf("\nlate-commands:\n  - %s\n", echoToken))...), nil
+	case "ignition":
+		return injectIgnitionShutdownHook(contents, echoToken)
+	}
+	return contents, nil
+}
+
+// injectIgnitionShutdownHook merges a oneshot systemd unit into an Ignition
+// config that runs once the firstboot install completes and echoes
+// echoToken to the serial console, giving ignition the same completion
+// signal the other answer file formats get from a late-command hook.
+func injectIgnitionShutdownHook(contents []byte, echoToken string) ([]byte, error) {
+	var config map[string]interface{}
+	if err := json.Unmarshal(contents, &config); err != nil {
+		return nil, fmt.Errorf("parsing ignition config: %w", err)
+	}
+
+	systemd, _ := config["systemd"].(map[string]interface{})
+	if systemd == nil {
+		systemd = map[string]interface{}{}
+	}
+	units, _ := systemd["units"].([]interface{})
+	units = append(units, map[string]interface{}{
+		"name":     ignitionShutdownUnitName,
+		"enabled":  true,
+		"contents": ignitionShutdownUnitContents(echoToken),
+	})
+	systemd["units"] = units
+	config["systemd"] = systemd
+
+	return json.Marshal(config)
+}
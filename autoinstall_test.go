@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestAutoinstallLayout(t *testing.T) {
+	tests := []struct {
+		autoinstallType, wantFilename, wantVolumeLabel string
+	}{
+		{"preseed", "preseed.cfg", "SEED"},
+		{"kickstart", "ks.cfg", "OEMDRV"},
+		{"autoinstall", "user-data", "cidata"},
+		{"ignition", "config.ign", "config-2"},
+		{"unknown", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.autoinstallType, func(t *testing.T) {
+			filename, volumeLabel := autoinstallLayout(tt.autoinstallType)
+			if filename != tt.wantFilename || volumeLabel != tt.wantVolumeLabel {
+				t.Errorf("autoinstallLayout(%q) = (%q, %q), want (%q, %q)",
+					tt.autoinstallType, filename, volumeLabel, tt.wantFilename, tt.wantVolumeLabel)
+			}
+		})
+	}
+}
+
+func TestAutoinstallKernelArgs(t *testing.T) {
+	tests := []struct {
+		autoinstallType string
+		want            string
+	}{
+		{"preseed", "auto=true priority=critical preseed/file=/cdrom/preseed.cfg"},
+		{"kickstart", "inst.ks=cdrom:/ks.cfg"},
+		{"autoinstall", "autoinstall ds=nocloud"},
+		{"ignition", "ignition.config.url=file:///cdrom/config.ign ignition.firstboot"},
+		{"unknown", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.autoinstallType, func(t *testing.T) {
+			if got := autoinstallKernelArgs(tt.autoinstallType); got != tt.want {
+				t.Errorf("autoinstallKernelArgs(%q) = %q, want %q", tt.autoinstallType, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInjectShutdownHook(t *testing.T) {
+	tests := []struct {
+		name            string
+		autoinstallType string
+		contains        string
+	}{
+		{"preseed", "preseed", "d-i preseed/late_command string in-target sh -c 'echo " + shutdownToken + " > /dev/ttyS0'"},
+		{"kickstart", "kickstart", "%post\necho " + shutdownToken + " > /dev/ttyS0\n%end"},
+		{"autoinstall", "autoinstall", "late-commands:\n  - echo " + shutdownToken + " > /dev/ttyS0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := injectShutdownHook([]byte("original\n"), tt.autoinstallType)
+			if err != nil {
+				t.Fatalf("injectShutdownHook() error = %v", err)
+			}
+			if !strings.HasPrefix(string(got), "original\n") {
+				t.Errorf("injectShutdownHook() dropped the original contents: %q", got)
+			}
+			if !strings.Contains(string(got), tt.contains) {
+				t.Errorf("injectShutdownHook() = %q, want it to contain %q", got, tt.contains)
+			}
+		})
+	}
+
+	t.Run("unknown type leaves contents untouched", func(t *testing.T) {
+		got, err := injectShutdownHook([]byte("original\n"), "unknown")
+		if err != nil {
+			t.Fatalf("injectShutdownHook() error = %v", err)
+		}
+		if string(got) != "original\n" {
+			t.Errorf("injectShutdownHook() = %q, want %q", got, "original\n")
+		}
+	})
+}
+
+func TestInjectIgnitionShutdownHook(t *testing.T) {
+	t.Run("merges into an empty config", func(t *testing.T) {
+		got, err := injectShutdownHook([]byte(`{"ignition":{"version":"3.3.0"}}`), "ignition")
+		if err != nil {
+			t.Fatalf("injectShutdownHook() error = %v", err)
+		}
+
+		var config map[string]interface{}
+		if err := json.Unmarshal(got, &config); err != nil {
+			t.Fatalf("result is not valid JSON: %v", err)
+		}
+
+		units := unitsFromConfig(t, config)
+		if len(units) != 1 {
+			t.Fatalf("got %d systemd units, want 1", len(units))
+		}
+		assertShutdownUnit(t, units[0])
+	})
+
+	t.Run("preserves existing units", func(t *testing.T) {
+		input := `{"ignition":{"version":"3.3.0"},"systemd":{"units":[{"name":"existing.service","enabled":true}]}}`
+		got, err := injectShutdownHook([]byte(input), "ignition")
+		if err != nil {
+			t.Fatalf("injectShutdownHook() error = %v", err)
+		}
+
+		var config map[string]interface{}
+		if err := json.Unmarshal(got, &config); err != nil {
+			t.Fatalf("result is not valid JSON: %v", err)
+		}
+
+		units := unitsFromConfig(t, config)
+		if len(units) != 2 {
+			t.Fatalf("got %d systemd units, want 2", len(units))
+		}
+		if units[0]["name"] != "existing.service" {
+			t.Errorf("existing unit was not preserved: %v", units[0])
+		}
+		assertShutdownUnit(t, units[1])
+	})
+
+	t.Run("invalid JSON is rejected", func(t *testing.T) {
+		if _, err := injectShutdownHook([]byte("not json"), "ignition"); err == nil {
+			t.Error("injectShutdownHook() error = nil, want an error for invalid JSON")
+		}
+	})
+}
+
+func unitsFromConfig(t *testing.T, config map[string]interface{}) []map[string]interface{} {
+	t.Helper()
+	systemd, ok := config["systemd"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("config has no systemd object: %v", config)
+	}
+	rawUnits, ok := systemd["units"].([]interface{})
+	if !ok {
+		t.Fatalf("systemd has no units array: %v", systemd)
+	}
+	units := make([]map[string]interface{}, len(rawUnits))
+	for i, u := range rawUnits {
+		units[i] = u.(map[string]interface{})
+	}
+	return units
+}
+
+func assertShutdownUnit(t *testing.T, unit map[string]interface{}) {
+	t.Helper()
+	if unit["name"] != ignitionShutdownUnitName {
+		t.Errorf("unit name = %v, want %q", unit["name"], ignitionShutdownUnitName)
+	}
+	if unit["enabled"] != true {
+		t.Errorf("unit enabled = %v, want true", unit["enabled"])
+	}
+	contents, _ := unit["contents"].(string)
+	if !strings.Contains(contents, shutdownToken) {
+		t.Errorf("unit contents = %q, want it to contain %q", contents, shutdownToken)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestConfigValid(t *testing.T) {
+	base := func() Config {
+		return Config{image: "myimage", isoFilepath: "install.iso", format: "qcow2"}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(c Config) Config
+		wantOK bool
+	}{
+		{"baseline iso install", func(c Config) Config { return c }, true},
+		{"missing image", func(c Config) Config { c.image = ""; return c }, false},
+		{"neither iso nor dockerfile", func(c Config) Config { c.isoFilepath = ""; return c }, false},
+		{"both iso and dockerfile", func(c Config) Config { c.dockerfilePath = "Dockerfile"; return c }, false},
+		{"dockerfile only", func(c Config) Config { c.isoFilepath = ""; c.dockerfilePath = "Dockerfile"; return c }, true},
+		{"unknown format", func(c Config) Config { c.format = "bogus"; return c }, false},
+		{"autoinstall with valid type", func(c Config) Config {
+			c.autoinstallFile, c.autoinstallType = "user-data", "autoinstall"
+			return c
+		}, true},
+		{"autoinstall with unknown type", func(c Config) Config {
+			c.autoinstallFile, c.autoinstallType = "user-data", "bogus"
+			return c
+		}, false},
+		{"autoinstall combined with dockerfile", func(c Config) Config {
+			c.isoFilepath = ""
+			c.dockerfilePath = "Dockerfile"
+			c.autoinstallFile, c.autoinstallType = "user-data", "autoinstall"
+			return c
+		}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.modify(base())
+			if got := c.valid(); got != tt.wantOK {
+				t.Errorf("valid() = %v, want %v (config: %+v)", got, tt.wantOK, c)
+			}
+		})
+	}
+}
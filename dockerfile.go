@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+const (
+	rootfsFilename = "rootfs.tar"
+	nbdDevice      = "/dev/nbd0"
+	mountDirName   = "mnt"
+)
+
+// buildSourceImage builds the user-supplied Dockerfile/context into a
+// tagged image that exportRootfs can later flatten into a tarball.
+func (i *Installer) buildSourceImage() (string, error) {
+	i.sourceImageTag = fmt.Sprintf("vm-installer-rootfs:%d", os.Getpid())
+
+	buildContext := i.config.buildContextDir
+	if buildContext == "" {
+		buildContext = filepath.Dir(i.config.dockerfilePath)
+	}
+
+	return i.runtime.Build(i.config.dockerfilePath, buildContext, i.sourceImageTag)
+}
+
+// exportRootfs flattens the built image into a plain tarball by creating a
+// container from it and exporting its filesystem, so that files such as
+// /etc/hostname and /etc/resolv.conf end up in the right place on a single
+// root rather than spread across layers.
+func (i *Installer) exportRootfs() (string, error) {
+	containerID, err := i.runtime.Create(i.sourceImageTag)
+	if err != nil {
+		return containerID, err
+	}
+	defer i.runtime.Remove(containerID)
+
+	i.rootfsFilepath = filepath.Join(i.contextDir, rootfsFilename)
+	return i.runtime.Export(containerID, i.rootfsFilepath)
+}
+
+// writeRootfsToImage partitions and formats the qcow2 image, unpacks the
+// exported rootfs into it, and installs extlinux into its MBR so the disk
+// boots standalone without ever having gone through a QEMU install.
+func (i *Installer) writeRootfsToImage() (string, error) {
+	if output, err := runStreamed("qemu-nbd", "--connect="+nbdDevice, i.imageFilepath); err != nil {
+		return output, err
+	}
+	defer exec.Command("qemu-nbd", "--disconnect", nbdDevice).Run()
+
+	if output, err := runStreamed("parted", "-s", nbdDevice, "mklabel", "msdos", "mkpart", "primary", "ext4", "1MiB", "100%", "set", "1", "boot", "on"); err != nil {
+		return output, err
+	}
+
+	partition := nbdDevice + "p1"
+	if output, err := runStreamed("mkfs.ext4", "-F", partition); err != nil {
+		return output, err
+	}
+
+	mountDir := filepath.Join(i.contextDir, mountDirName)
+	if err := os.MkdirAll(mountDir, 0755); err != nil {
+		return "", err
+	}
+	if output, err := runStreamed("mount", partition, mountDir); err != nil {
+		return output, err
+	}
+	defer exec.Command("umount", mountDir).Run()
+
+	if output, err := runStreamed("tar", "-xpf", i.rootfsFilepath, "-C", mountDir); err != nil {
+		return output, err
+	}
+
+	if err := i.installBootloader(mountDir); err != nil {
+		return "", err
+	}
+
+	if output, err := runStreamed("extlinux", "--install", filepath.Join(mountDir, "boot")); err != nil {
+		return output, err
+	}
+	return runStreamed("dd", "if=/usr/lib/syslinux/mbr/mbr.bin", "of="+nbdDevice)
+}
+
+// installBootloader locates the rootfs's kernel and initrd under /boot and
+// writes an extlinux.conf that boots them with the root filesystem mounted
+// from the image's first partition.
+func (i *Installer) installBootloader(mountDir string) error {
+	bootDir := filepath.Join(mountDir, "boot")
+	kernel, err := findBootFile(bootDir, "vmlinuz-*")
+	if err != nil {
+		return err
+	}
+	initrd, err := findBootFile(bootDir, "initrd.img-*")
+	if err != nil {
+		return err
+	}
+
+	cfg := fmt.Sprintf("DEFAULT linux\nLABEL linux\n  KERNEL /boot/%s\n  INITRD /boot/%s\n  APPEND root=/dev/vda1 rw\n",
+		filepath.Base(kernel), filepath.Base(initrd))
+	return ioutil.WriteFile(filepath.Join(bootDir, "extlinux.conf"), []byte(cfg), 0644)
+}
+
+// findBootFile returns the newest file under dir matching glob, since a
+// rootfs may carry more than one installed kernel package.
+func findBootFile(dir, glob string) (string, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, glob))
+	if err != nil {
+		return "", err
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("no files matching %s in %s", glob, dir)
+	}
+	return matches[len(matches)-1], nil
+}
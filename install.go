@@ -2,92 +2,193 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
 )
 
 const (
 	imageFilename = "base.qcow2"
+
+	// shutdownToken is what preseed/kickstart/autoinstall answer files are
+	// configured to echo to the serial console once the unattended install
+	// finishes, so the host can tell runMachine to drive a QMP shutdown.
+	shutdownToken = "VM-INSTALLER-SHUTDOWN"
+
+	snapshotTag         = "vm-installer"
+	shutdownGracePeriod = 30 * time.Second
 )
 
+var validFormats = map[string]bool{
+	"qcow2":    true,
+	"raw":      true,
+	"vmdk":     true,
+	"vdi":      true,
+	"kubevirt": true,
+}
+
+var validAutoinstallTypes = map[string]bool{
+	"preseed":     true,
+	"kickstart":   true,
+	"autoinstall": true,
+	"ignition":    true,
+}
+
 type Config struct {
-	isoFilepath string
-	imageSize   string
-	image       string
-	kvm         bool
-	compress    bool
+	isoFilepath           string
+	dockerfilePath        string
+	buildContextDir       string
+	imageSize             string
+	image                 string
+	format                string
+	autoinstallFile       string
+	autoinstallType       string
+	runtime               string
+	registry              string
+	registryUser          string
+	registryPassword      string
+	registryPasswordStdin bool
+	registryInsecure      bool
+	logLevel              string
+	logJSON               bool
+	installTimeout        time.Duration
+	snapshotOnComplete    bool
+	kvm                   bool
+	compress              bool
+}
+
+// valid reports whether c is a self-consistent set of flags: exactly one of
+// -iso/-dockerfile is required, -format must be one of validFormats, and
+// -autoinstall (which only applies to the -iso path) requires a recognized
+// -autoinstall-type.
+func (c Config) valid() bool {
+	if c.image == "" || (c.isoFilepath == "") == (c.dockerfilePath == "") || !validFormats[c.format] {
+		return false
+	}
+	if c.autoinstallFile != "" && (!validAutoinstallTypes[c.autoinstallType] || c.dockerfilePath != "") {
+		return false
+	}
+	return true
 }
 
 func newConfigFromFlags() (c Config) {
 	flag.StringVar(&c.isoFilepath, "iso", "", "path to operating system iso file")
+	flag.StringVar(&c.dockerfilePath, "dockerfile", "", "path to a Dockerfile to build into the machine image instead of an interactive -iso install")
+	flag.StringVar(&c.buildContextDir, "context", "", "build context directory for -dockerfile (defaults to the Dockerfile's directory)")
 	flag.StringVar(&c.imageSize, "size", "50G", "size of the virtual machine image")
 	flag.StringVar(&c.image, "image", "", "name of the Docker image")
+	flag.StringVar(&c.format, "format", "qcow2", "output image format: qcow2, raw, vmdk, vdi, or kubevirt (KubeVirt containerDisk)")
+	flag.StringVar(&c.autoinstallFile, "autoinstall", "", "path to an unattended install answer file (preseed.cfg, ks.cfg, user-data, or config.ign)")
+	flag.StringVar(&c.autoinstallType, "autoinstall-type", "", "answer file format: preseed, kickstart, autoinstall, or ignition (required with -autoinstall)")
+	flag.StringVar(&c.runtime, "runtime", "", "container runtime to use: docker, podman, or nerdctl (default: auto-detect from PATH)")
+	flag.StringVar(&c.registry, "registry", "", "registry host to prefix -image with and to authenticate against")
+	flag.StringVar(&c.registryUser, "registry-user", "", "username for -registry")
+	flag.StringVar(&c.registryPassword, "registry-password", "", "password for -registry")
+	flag.BoolVar(&c.registryPasswordStdin, "registry-password-stdin", false, "read the -registry password from stdin")
+	flag.BoolVar(&c.registryInsecure, "registry-insecure", false, "allow pushing to -registry over plain HTTP / without TLS verification")
+	flag.StringVar(&c.logLevel, "log-level", "info", "log level: debug, info, warn, or error")
+	flag.BoolVar(&c.logJSON, "log-json", false, "emit logs as newline-delimited JSON instead of human-readable text")
+	flag.DurationVar(&c.installTimeout, "install-timeout", 0, "fail the install if the guest hasn't shut down within this duration (0 disables the timeout)")
+	flag.BoolVar(&c.snapshotOnComplete, "snapshot-on-complete", false, "snapshot the running guest via QMP savevm instead of powering it down when the install completes")
 	flag.BoolVar(&c.kvm, "kvm", false, "enable KVM full virtualization support")
 	flag.BoolVar(&c.compress, "compress", false, "compress virtual machine image after installation")
 	flag.Parse()
-	if c.isoFilepath == "" || c.image == "" {
+	if !c.valid() {
 		flag.Usage()
 		os.Exit(1)
 	}
+	configureLogging(c.logLevel, c.logJSON)
 	return
 }
 
 type Installer struct {
-	config        Config
-	contextDir    string
-	imageFilepath string
+	config         Config
+	runtime        ContainerRuntime
+	contextDir     string
+	imageFilepath  string
+	rootfsFilepath string
+	sourceImageTag string
 }
 
-func newInstaller(config Config) (i Installer, err error) {
+func newInstaller(config Config, runtime ContainerRuntime) (i Installer, err error) {
 	i.config = config
+	i.runtime = runtime
 	i.contextDir, err = ioutil.TempDir("", "docker-context")
 	i.imageFilepath = filepath.Join(i.contextDir, imageFilename)
 	return
 }
 
 func (i *Installer) Install() error {
-	log.Printf("Context dir: %s\n", i.contextDir)
+	logger.Info().Str("dir", i.contextDir).Msg("context dir")
 	defer os.RemoveAll(i.contextDir)
 
-	log.Println("Creating machine image...")
+	logger.Info().Msg("Creating machine image...")
 	output, err := i.createImage()
 	if err != nil {
-		log.Print(output)
+		logger.Error().Msg(output)
 		return err
 	}
 
-	log.Println("Starting machine...")
-	output, err = i.runMachine()
-	if err != nil {
-		log.Print(output)
-		return err
+	if i.config.dockerfilePath != "" {
+		logger.Info().Msg("Building source image from Dockerfile...")
+		if output, err := i.buildSourceImage(); err != nil {
+			logger.Error().Msg(output)
+			return err
+		}
+
+		logger.Info().Msg("Exporting container filesystem...")
+		if output, err := i.exportRootfs(); err != nil {
+			logger.Error().Msg(output)
+			return err
+		}
+
+		logger.Info().Msg("Writing root filesystem to machine image...")
+		if output, err := i.writeRootfsToImage(); err != nil {
+			logger.Error().Msg(output)
+			return err
+		}
+	} else {
+		logger.Info().Msg("Starting machine...")
+		output, err = i.runMachine()
+		if err != nil {
+			logger.Error().Msg(output)
+			return err
+		}
 	}
 
 	if i.config.compress {
-		log.Println("Compressing image...")
+		logger.Info().Msg("Compressing image...")
 		if output, err := i.compressImage(); err != nil {
-			log.Print(output)
+			logger.Error().Msg(output)
 			return err
 		}
 	}
 
-	log.Println("Building Docker image...")
+	logger.Info().Msg("Converting image...")
+	if output, err := i.convertImage(); err != nil {
+		logger.Error().Msg(output)
+		return err
+	}
+
+	logger.Info().Msg("Building Docker image...")
 	output, err = i.buildImage()
 	if err != nil {
-		log.Print(output)
+		logger.Error().Msg(output)
 		return err
 	}
 
-	log.Println("Pushing Docker image...")
+	logger.Info().Msg("Pushing Docker image...")
 	output, err = i.pushImage()
 	if err != nil {
-		log.Print(output)
+		logger.Error().Msg(output)
 		return err
 	}
 
@@ -95,25 +196,37 @@ func (i *Installer) Install() error {
 }
 
 func (i *Installer) createImage() (string, error) {
-	cmd := exec.Command("qemu-img", "create", "-f", "qcow2", i.imageFilepath, i.config.imageSize)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err := cmd.Run()
-	return out.String(), err
+	return runStreamed("qemu-img", "create", "-f", "qcow2", i.imageFilepath, i.config.imageSize)
 }
 
 func (i *Installer) compressImage() (string, error) {
 	tempFilepath := i.imageFilepath + ".temp"
-	cmd := exec.Command("qemu-img", "convert", "-O", "qcow2", "-c", i.imageFilepath, tempFilepath)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err := cmd.Run()
+	output, err := runStreamed("qemu-img", "convert", "-O", "qcow2", "-c", i.imageFilepath, tempFilepath)
 	if err != nil {
-		return out.String(), err
+		return output, err
 	}
 
 	err = os.Rename(tempFilepath, i.imageFilepath)
-	return out.String(), err
+	return output, err
+}
+
+// convertImage converts the qcow2 image produced by createImage into the
+// configured output format, renaming the artifact by extension. qcow2 is a
+// no-op, and kubevirt packages the qcow2 as-is inside a containerDisk rather
+// than converting it.
+func (i *Installer) convertImage() (string, error) {
+	if i.config.format == "qcow2" || i.config.format == "kubevirt" {
+		return "", nil
+	}
+
+	convertedFilepath := strings.TrimSuffix(i.imageFilepath, filepath.Ext(i.imageFilepath)) + "." + i.config.format
+	output, err := runStreamed("qemu-img", "convert", "-O", i.config.format, i.imageFilepath, convertedFilepath)
+	if err != nil {
+		return output, err
+	}
+
+	i.imageFilepath = convertedFilepath
+	return output, nil
 }
 
 func (i *Installer) buildImage() (string, error) {
@@ -121,56 +234,179 @@ func (i *Installer) buildImage() (string, error) {
 		return "", err
 	}
 
-	cmd := exec.Command("docker", "build", "-t", i.config.image, i.contextDir)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err := cmd.Run()
-	return out.String(), err
+	return i.runtime.Build("", i.contextDir, i.imageName())
 }
 
 func (i *Installer) pushImage() (string, error) {
-	cmd := exec.Command("docker", "push", i.config.image)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err := cmd.Run()
-	return out.String(), err
+	if i.config.registry != "" && i.config.registryUser != "" {
+		password, err := i.resolveRegistryPassword()
+		if err != nil {
+			return "", err
+		}
+		if output, err := i.runtime.Login(i.config.registry, i.config.registryUser, password, i.config.registryInsecure); err != nil {
+			return output, err
+		}
+	}
+
+	return i.runtime.Push(i.imageName(), i.config.registryInsecure)
+}
+
+// imageName returns -image prefixed with -registry, if one was configured.
+func (i *Installer) imageName() string {
+	if i.config.registry == "" {
+		return i.config.image
+	}
+	return i.config.registry + "/" + i.config.image
+}
+
+// resolveRegistryPassword returns the configured -registry-password, or
+// reads it from stdin when -registry-password-stdin was set.
+func (i *Installer) resolveRegistryPassword() (string, error) {
+	if !i.config.registryPasswordStdin {
+		return i.config.registryPassword, nil
+	}
+
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimSpace(password), nil
 }
 
 func (i *Installer) writeDockerfile() error {
 	dockerFilepath := filepath.Join(i.contextDir, "Dockerfile")
 	imageFilename := filepath.Base(i.imageFilepath)
-	dockerfileContents := fmt.Sprintf("FROM busybox\nCOPY %s /base_image/", imageFilename)
+
+	var dockerfileContents string
+	if i.config.format == "kubevirt" {
+		dockerfileContents = fmt.Sprintf("FROM scratch\nADD %s /disk/", imageFilename)
+	} else {
+		dockerfileContents = fmt.Sprintf("FROM busybox\nCOPY %s /base_image/", imageFilename)
+	}
 	return ioutil.WriteFile(dockerFilepath, []byte(dockerfileContents), 0777)
 }
 
 func (i *Installer) runMachine() (string, error) {
-	cmd := exec.Command("qemu-system-x86_64",
+	qmpSockPath := filepath.Join(i.contextDir, "qmp.sock")
+
+	args := []string{
 		"-m", "size=1024",
 		"-smp", "cpus=1",
 		"-cdrom", i.config.isoFilepath,
 		"-vnc", "0.0.0.0:0",
-		"-drive", fmt.Sprintf("file=%s", i.imageFilepath))
+		"-drive", fmt.Sprintf("file=%s", i.imageFilepath),
+		"-qmp", fmt.Sprintf("unix:%s,server,nowait", qmpSockPath),
+		"-monitor", "none",
+		"-serial", "stdio",
+	}
+
+	unattended := i.config.autoinstallFile != ""
+	if unattended {
+		autoinstallArgs, output, err := i.prepareAutoinstall()
+		if err != nil {
+			return output, err
+		}
+		args = append(args, autoinstallArgs...)
+	}
+
+	cmd := exec.Command("qemu-system-x86_64", args...)
 	if i.config.kvm {
 		cmd.Args = append([]string{cmd.Args[0], "-enable-kvm"}, cmd.Args[1:]...)
 	}
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err := cmd.Start()
+
+	serial, err := cmd.StdoutPipe()
 	if err != nil {
-		return out.String(), err
+		return "", err
 	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return "", err
+	}
+	go logLines(stderr, "qemu-system-x86_64", zerolog.WarnLevel)
 
-	go func() {
-		reader := bufio.NewReader(os.Stdin)
-		log.Println("Press [enter] when installation is complete.")
-		_, _ = reader.ReadString('\n')
+	shutdownSignal := make(chan struct{}, 1)
+	go watchSerial(serial, shutdownSignal)
 
-		err = cmd.Process.Signal(os.Interrupt)
-		if err != nil {
-			log.Fatal(err)
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+
+	qmp, err := dialQMP(qmpSockPath)
+	if err != nil {
+		cmd.Process.Kill()
+		return "", err
+	}
+	defer qmp.Close()
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	if unattended {
+		logger.Info().Msg("Waiting for unattended installation to signal completion...")
+	} else {
+		go func() {
+			reader := bufio.NewReader(os.Stdin)
+			logger.Info().Msg("Press [enter] when installation is complete.")
+			_, _ = reader.ReadString('\n')
+			shutdownSignal <- struct{}{}
+		}()
+	}
+
+	var timeout <-chan time.Time
+	if i.config.installTimeout > 0 {
+		timer := time.NewTimer(i.config.installTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-shutdownSignal:
+		if err := i.shutdownGuest(qmp); err != nil {
+			logger.Warn().Err(err).Msg("QMP shutdown request failed")
+		}
+	case err := <-exited:
+		return "", err
+	case <-timeout:
+		qmp.Quit()
+		return "", fmt.Errorf("install timed out after %s waiting for the guest to shut down", i.config.installTimeout)
+	}
+
+	select {
+	case err := <-exited:
+		return "", err
+	case <-time.After(shutdownGracePeriod):
+		logger.Warn().Msg("guest did not shut down within the grace period, forcing qemu to quit")
+		qmp.Quit()
+		return "", <-exited
+	}
+}
+
+// shutdownGuest powers the guest down via QMP, or snapshots it in place
+// when -snapshot-on-complete is set so the produced image resumes from a
+// running state instead of a clean shutdown.
+func (i *Installer) shutdownGuest(qmp *qmpClient) error {
+	if i.config.snapshotOnComplete {
+		if err := qmp.SaveSnapshot(snapshotTag); err != nil {
+			return err
 		}
-	}()
+		return qmp.Quit()
+	}
+	return qmp.Powerdown()
+}
 
-	err = cmd.Wait()
-	return out.String(), err
+// watchSerial logs the guest's serial console line-by-line and signals once
+// it prints shutdownToken, which preseed/kickstart/autoinstall answer files
+// are configured to echo when the unattended install finishes.
+func watchSerial(r io.Reader, shutdownSignal chan<- struct{}) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		logger.Info().Str("cmd", "qemu-serial").Msg(line)
+		if strings.Contains(line, shutdownToken) {
+			select {
+			case shutdownSignal <- struct{}{}:
+			default:
+			}
+		}
+	}
 }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"os"
+	"testing"
+)
+
+func TestImageName(t *testing.T) {
+	tests := []struct {
+		name     string
+		registry string
+		image    string
+		want     string
+	}{
+		{"no registry", "", "myimage", "myimage"},
+		{"with registry", "registry.example.com", "myimage", "registry.example.com/myimage"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := Installer{config: Config{registry: tt.registry, image: tt.image}}
+			if got := i.imageName(); got != tt.want {
+				t.Errorf("imageName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveRegistryPassword(t *testing.T) {
+	t.Run("flag password", func(t *testing.T) {
+		i := Installer{config: Config{registryPassword: "hunter2"}}
+		got, err := i.resolveRegistryPassword()
+		if err != nil {
+			t.Fatalf("resolveRegistryPassword() error = %v", err)
+		}
+		if got != "hunter2" {
+			t.Errorf("resolveRegistryPassword() = %q, want %q", got, "hunter2")
+		}
+	})
+
+	t.Run("stdin with trailing newline", func(t *testing.T) {
+		got, err := resolveRegistryPasswordFromStdin(t, "hunter2\n")
+		if err != nil {
+			t.Fatalf("resolveRegistryPassword() error = %v", err)
+		}
+		if got != "hunter2" {
+			t.Errorf("resolveRegistryPassword() = %q, want %q", got, "hunter2")
+		}
+	})
+
+	t.Run("stdin without trailing newline", func(t *testing.T) {
+		// e.g. `printf '%s' "$PASS" | vm-installer ...` or secret-manager
+		// output that doesn't append a newline.
+		got, err := resolveRegistryPasswordFromStdin(t, "hunter2")
+		if err != nil {
+			t.Fatalf("resolveRegistryPassword() error = %v", err)
+		}
+		if got != "hunter2" {
+			t.Errorf("resolveRegistryPassword() = %q, want %q", got, "hunter2")
+		}
+	})
+}
+
+// resolveRegistryPasswordFromStdin swaps os.Stdin for a pipe carrying input,
+// calls resolveRegistryPassword, and restores os.Stdin afterwards.
+func resolveRegistryPasswordFromStdin(t *testing.T, input string) (string, error) {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("os.Pipe() error = %v", err)
+	}
+	if _, err := io.WriteString(w, input); err != nil {
+		t.Fatalf("write to pipe: %v", err)
+	}
+	w.Close()
+
+	oldStdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = oldStdin }()
+
+	i := Installer{config: Config{registryPasswordStdin: true}}
+	return i.resolveRegistryPassword()
+}
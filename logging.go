@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+var logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).With().Timestamp().Logger()
+
+// configureLogging sets the global log level and switches between the
+// human-readable console writer and newline-delimited JSON, per -log-level
+// and -log-json.
+func configureLogging(level string, asJSON bool) {
+	parsed, err := zerolog.ParseLevel(level)
+	if err != nil {
+		parsed = zerolog.InfoLevel
+	}
+	zerolog.SetGlobalLevel(parsed)
+
+	if asJSON {
+		logger = zerolog.New(os.Stderr).With().Timestamp().Logger()
+	} else {
+		logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).With().Timestamp().Logger()
+	}
+}
+
+// logLines scans r line-by-line, logging each line through the global
+// logger tagged with the sub-command name that produced it.
+func logLines(r io.Reader, cmdName string, level zerolog.Level) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		logger.WithLevel(level).Str("cmd", cmdName).Msg(scanner.Text())
+	}
+}
+
+// runStreamed runs name with args, streaming its stdout and stderr
+// line-by-line through the global logger tagged with name (INFO for stdout,
+// WARN for stderr) instead of buffering everything until the process exits.
+// The combined output is still returned so callers can log it again
+// alongside a returned error.
+func runStreamed(name string, args ...string) (string, error) {
+	return runStreamedAs(name, name, args...)
+}
+
+// runStreamedAs is runStreamed with the log tag (label) decoupled from the
+// binary actually executed (name), so callers invoking e.g. "docker build"
+// and "docker push" can tag their log lines distinctly.
+func runStreamedAs(label, name string, args ...string) (string, error) {
+	return runStreamedAsWithStdin(label, name, "", args...)
+}
+
+// runStreamedAsWithStdin is runStreamedAs but also pipes stdin into the
+// child process's stdin, for callers like Login that need to hand a
+// secret to a subprocess without putting it on argv.
+func runStreamedAsWithStdin(label, name, stdin string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return "", err
+	}
+
+	var mu sync.Mutex
+	var combined []string
+	var wg sync.WaitGroup
+
+	stream := func(r io.Reader, level zerolog.Level) {
+		defer wg.Done()
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			line := scanner.Text()
+			mu.Lock()
+			combined = append(combined, line)
+			mu.Unlock()
+			logger.WithLevel(level).Str("cmd", label).Msg(line)
+		}
+	}
+
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+
+	wg.Add(2)
+	go stream(stdout, zerolog.InfoLevel)
+	go stream(stderr, zerolog.WarnLevel)
+	wg.Wait()
+
+	err = cmd.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	output := ""
+	for _, line := range combined {
+		output += line + "\n"
+	}
+	return output, err
+}
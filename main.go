@@ -2,11 +2,10 @@ package main
 
 import (
 	"bytes"
-	"log"
 	"os/exec"
 )
 
-var processList = []string{"docker", "qemu-system-x86_64", "qemu-img"}
+var processList = []string{"qemu-system-x86_64", "qemu-img"}
 
 func getFilepath(processName string) (string, error) {
 	cmd := exec.Command("which", processName)
@@ -17,20 +16,33 @@ func getFilepath(processName string) (string, error) {
 }
 
 func main() {
-	for _, process := range processList {
-		_, err := getFilepath(process)
-		if err != nil {
-			log.Fatal("Missing dependency: ", process)
+	config := newConfigFromFlags()
+
+	runtime, err := newContainerRuntime(config.runtime)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to select container runtime")
+	}
+
+	processes := append(processList, runtime.Binary())
+	if config.dockerfilePath != "" {
+		processes = append(processes, "qemu-nbd", "parted", "mkfs.ext4", "extlinux", "tar", "mount", "umount", "dd")
+	}
+	if config.autoinstallFile != "" {
+		processes = append(processes, "genisoimage")
+	}
+
+	for _, process := range processes {
+		if _, err := getFilepath(process); err != nil {
+			logger.Fatal().Str("process", process).Msg("missing dependency")
 		}
 	}
 
-	config := newConfigFromFlags()
-	installer, err := newInstaller(config)
+	installer, err := newInstaller(config, runtime)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal().Err(err).Msg("failed to initialize installer")
 	}
 	if err := installer.Install(); err != nil {
-		log.Fatal(err)
+		logger.Fatal().Err(err).Msg("install failed")
 	}
-	log.Println("Done.")
+	logger.Info().Msg("Done.")
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+// qmpClient is a minimal synchronous client for QEMU's QMP JSON protocol,
+// used to drive guest shutdown instead of sending SIGINT to the
+// qemu-system-x86_64 process, which can leave the qcow2 image dirty.
+type qmpClient struct {
+	conn net.Conn
+	dec  *json.Decoder
+}
+
+// dialQMP connects to a QMP unix socket, retrying briefly while QEMU
+// finishes creating it, then completes the capabilities negotiation
+// handshake.
+func dialQMP(sockPath string) (*qmpClient, error) {
+	var conn net.Conn
+	var err error
+	for attempt := 0; attempt < 25; attempt++ {
+		conn, err = net.Dial("unix", sockPath)
+		if err == nil {
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connecting to QMP socket: %w", err)
+	}
+
+	c := &qmpClient{conn: conn, dec: json.NewDecoder(conn)}
+
+	var greeting map[string]interface{}
+	if err := c.dec.Decode(&greeting); err != nil {
+		return nil, fmt.Errorf("reading QMP greeting: %w", err)
+	}
+	if err := c.execute("qmp_capabilities", nil); err != nil {
+		return nil, fmt.Errorf("negotiating QMP capabilities: %w", err)
+	}
+	return c, nil
+}
+
+// execute sends a QMP command and waits for its matching "return" or
+// "error" reply, skipping over any asynchronous events received first.
+func (c *qmpClient) execute(command string, args map[string]interface{}) error {
+	request := map[string]interface{}{"execute": command}
+	if args != nil {
+		request["arguments"] = args
+	}
+	if err := json.NewEncoder(c.conn).Encode(request); err != nil {
+		return err
+	}
+
+	for {
+		var reply map[string]interface{}
+		if err := c.dec.Decode(&reply); err != nil {
+			return err
+		}
+		if errReply, ok := reply["error"]; ok {
+			return fmt.Errorf("qmp %s failed: %v", command, errReply)
+		}
+		if _, ok := reply["return"]; ok {
+			return nil
+		}
+	}
+}
+
+// Powerdown sends an ACPI shutdown request to the guest, equivalent to
+// pressing the power button, so it has a chance to shut down cleanly.
+func (c *qmpClient) Powerdown() error {
+	return c.execute("system_powerdown", nil)
+}
+
+// Quit forcibly terminates QEMU, used as a fallback once the powerdown
+// grace period has elapsed.
+func (c *qmpClient) Quit() error {
+	return c.execute("quit", nil)
+}
+
+// SaveSnapshot issues a savevm via the human-monitor-command passthrough so
+// the produced qcow2 resumes from a running snapshot rather than a clean
+// shutdown.
+func (c *qmpClient) SaveSnapshot(tag string) error {
+	return c.execute("human-monitor-command", map[string]interface{}{"command-line": "savevm " + tag})
+}
+
+func (c *qmpClient) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// ContainerRuntime abstracts the container CLI used to build, export, and
+// push images, so vm-installer can run against Docker, Podman, or nerdctl.
+type ContainerRuntime interface {
+	Name() string
+	Binary() string
+	Build(dockerfile, context, tag string) (string, error)
+	Create(image string) (string, error)
+	Export(containerID, outputPath string) (string, error)
+	Remove(containerID string) (string, error)
+	Login(registry, user, password string, insecure bool) (string, error)
+	Push(image string, insecure bool) (string, error)
+}
+
+// cliRuntime implements ContainerRuntime against any Docker CLI-compatible
+// binary; Docker, Podman, and nerdctl all accept the same
+// build/create/export/push subcommands.
+type cliRuntime struct {
+	name   string
+	binary string
+}
+
+func (r cliRuntime) Name() string   { return r.name }
+func (r cliRuntime) Binary() string { return r.binary }
+
+// run streams args through runStreamed, tagging log lines with the binary
+// and subcommand (e.g. "docker build") rather than just the binary name.
+func (r cliRuntime) run(args ...string) (string, error) {
+	return r.runWithStdin("", args...)
+}
+
+// runWithStdin is run but also pipes stdin into the subprocess, for
+// subcommands like login --password-stdin that read a secret off stdin
+// instead of taking it as an argument.
+func (r cliRuntime) runWithStdin(stdin string, args ...string) (string, error) {
+	label := r.binary
+	if len(args) > 0 {
+		label = r.binary + " " + args[0]
+	}
+	return runStreamedAsWithStdin(label, r.binary, stdin, args...)
+}
+
+func (r cliRuntime) Build(dockerfile, context, tag string) (string, error) {
+	args := []string{"build", "-t", tag}
+	if dockerfile != "" {
+		args = append(args, "-f", dockerfile)
+	}
+	args = append(args, context)
+	return r.run(args...)
+}
+
+func (r cliRuntime) Create(image string) (string, error) {
+	out, err := r.run("create", image)
+	return strings.TrimSpace(out), err
+}
+
+func (r cliRuntime) Export(containerID, outputPath string) (string, error) {
+	return r.run("export", "-o", outputPath, containerID)
+}
+
+func (r cliRuntime) Remove(containerID string) (string, error) {
+	return r.run("rm", containerID)
+}
+
+func (r cliRuntime) Login(registry, user, password string, insecure bool) (string, error) {
+	args := []string{"login", "--username", user, "--password-stdin"}
+	args = append(args, r.insecureArgs(insecure)...)
+	return r.runWithStdin(password, append(args, registry)...)
+}
+
+func (r cliRuntime) Push(image string, insecure bool) (string, error) {
+	args := append([]string{"push"}, r.insecureArgs(insecure)...)
+	return r.run(append(args, image)...)
+}
+
+// insecureArgs returns the flag that skips TLS verification, for the
+// runtimes that support one. Docker has no such CLI flag; insecure Docker
+// registries are instead configured in the daemon, which is out of scope
+// here.
+func (r cliRuntime) insecureArgs(insecure bool) []string {
+	if insecure && r.name != "docker" {
+		return []string{"--tls-verify=false"}
+	}
+	return nil
+}
+
+// newContainerRuntime resolves the -runtime flag to a ContainerRuntime,
+// auto-detecting one from PATH when name is empty.
+func newContainerRuntime(name string) (ContainerRuntime, error) {
+	switch name {
+	case "docker":
+		return cliRuntime{name: "docker", binary: "docker"}, nil
+	case "podman":
+		return cliRuntime{name: "podman", binary: "podman"}, nil
+	case "nerdctl":
+		return cliRuntime{name: "nerdctl", binary: "nerdctl"}, nil
+	case "":
+		return detectContainerRuntime()
+	}
+	return nil, fmt.Errorf("unknown -runtime %q: must be docker, podman, or nerdctl", name)
+}
+
+// detectContainerRuntime picks the first of docker, podman, or nerdctl found
+// on PATH.
+func detectContainerRuntime() (ContainerRuntime, error) {
+	for _, name := range []string{"docker", "podman", "nerdctl"} {
+		if _, err := exec.LookPath(name); err == nil {
+			return newContainerRuntime(name)
+		}
+	}
+	return nil, fmt.Errorf("no container runtime found on PATH (looked for docker, podman, nerdctl)")
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInsecureArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		runtime  string
+		insecure bool
+		want     []string
+	}{
+		{"docker never gets a flag", "docker", true, nil},
+		{"podman insecure", "podman", true, []string{"--tls-verify=false"}},
+		{"nerdctl insecure", "nerdctl", true, []string{"--tls-verify=false"}},
+		{"podman secure", "podman", false, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := cliRuntime{name: tt.runtime, binary: tt.runtime}
+			if got := r.insecureArgs(tt.insecure); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("insecureArgs(%v) = %v, want %v", tt.insecure, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewContainerRuntime(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{"docker", "docker", false},
+		{"podman", "podman", false},
+		{"nerdctl", "nerdctl", false},
+		{"unknown", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, err := newContainerRuntime(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newContainerRuntime(%q) error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			if err == nil && rt.Binary() != tt.want {
+				t.Errorf("newContainerRuntime(%q).Binary() = %q, want %q", tt.name, rt.Binary(), tt.want)
+			}
+		})
+	}
+}